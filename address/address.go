@@ -1,13 +1,20 @@
 package address
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"net"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/TrilliumIT/iputil"
 	log "github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -21,6 +28,22 @@ const (
 	DefaultPropagationTimeout = 250 * time.Millisecond
 )
 
+//myPriority is this node's stable tiebreaker, written into every route's
+//Priority so simultaneous claims to the same address resolve deterministically
+//instead of requiring every contender to back off and retry.
+var myPriority = nodePriority()
+
+//nodePriority derives a stable 32-bit tiebreaker from the host's hostname
+func nodePriority() uint32 {
+	host, err := os.Hostname()
+	if err != nil {
+		host = strconv.Itoa(os.Getpid())
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(host))
+	return h.Sum32()
+}
+
 //Address represents an address allocated by the IPAM
 type Address struct {
 	IPNet     *net.IPNet
@@ -41,6 +64,17 @@ func New(cidr string, linkIndex, excludeFirst, excludeLast int) (*Address, error
 		return nil, handlerr(err)
 	}
 
+	if err := a.allocate(excludeFirst, excludeLast); err != nil {
+		return nil, handlerr(err)
+	}
+
+	return a, nil
+}
+
+//allocate searches the subnet for a free address (or claims the exact
+//address already set on a.IPNet if it isn't the network ID) and installs
+//it into the routing table. It is shared by New and Pool.Allocate.
+func (a *Address) allocate(excludeFirst, excludeLast int) error {
 	search := false
 	var startAddr net.IP
 	var firstAddr net.IP
@@ -54,9 +88,9 @@ func New(cidr string, linkIndex, excludeFirst, excludeLast int) (*Address, error
 	}
 
 	for {
-		err = a.attempt()
+		err := a.attempt()
 		if err == nil {
-			break
+			return nil
 		}
 
 		if search {
@@ -68,14 +102,12 @@ func New(cidr string, linkIndex, excludeFirst, excludeLast int) (*Address, error
 			}
 
 			if a.IP().Equal(startAddr) {
-				return nil, handlerr(fmt.Errorf("exhausted address space and found no available address in %v", iputil.NetworkID(a.IPNet)))
+				return fmt.Errorf("exhausted address space and found no available address in %v", iputil.NetworkID(a.IPNet))
 			}
 		}
 
 		time.Sleep(DefaultRequestedAddressSleepTime)
 	}
-
-	return a, nil
 }
 
 //Get returns a populated Address struct
@@ -120,29 +152,45 @@ func (a *Address) attempt() error {
 		return handlerr(fmt.Errorf("cannot request the broadcast address %v", a.IPNet))
 	}
 
-	numRoutes, err := a.numRoutes()
+	routes, err := a.numRoutes()
 	if err != nil {
 		return handlerr(err)
 	}
-	if numRoutes > 0 {
+	if len(routes) > 0 {
 		return handlerr(fmt.Errorf("address %v already in use", a.IPNet))
 	}
 
-	// add host route to routing table
+	// subscribe before adding our route so we can't miss a competing
+	// route that propagates in between the add and the wait below
+	updates := make(chan netlink.RouteUpdate)
+	done := make(chan struct{})
+	err = netlink.RouteSubscribeWithOptions(updates, done, netlink.RouteSubscribeOptions{
+		ErrorCallback: func(err error) {
+			log.WithError(err).Warning("route subscription error")
+		},
+	})
+	if err != nil {
+		return handlerr(err)
+	}
+	defer close(done)
+
+	// add host route to routing table, tagged with our tiebreaker
 	err = netlink.RouteAdd(&netlink.Route{
 		LinkIndex: a.linkIndex,
 		Dst:       a.hostNet(),
 		Protocol:  DefaultRouteProtocol,
+		Priority:  int(myPriority),
 	})
 	if err != nil {
 		return handlerr(err)
 	}
 
-	//wait for at least estimated route propagation time
-	time.Sleep(DefaultPropagationTimeout)
+	//wait for at least estimated route propagation time, but return as
+	//soon as a foreign route for our address shows up
+	a.waitForForeignRoute(updates, DefaultPropagationTimeout)
 
 	//check that we are still the only route
-	numRoutes, err = a.numRoutes()
+	routes, err = a.numRoutes()
 	if err != nil {
 		err2 := a.Delete()
 		if err2 != nil {
@@ -151,23 +199,96 @@ func (a *Address) attempt() error {
 		return handlerr(err)
 	}
 
-	if numRoutes < 1 {
+	if len(routes) < 1 {
 		// The route either wasn't successfully added, or was removed,
 		// let the outer loop try again
 		return handlerr(fmt.Errorf("added %v to the routing table, but it was gone when we checked", a.IPNet))
 	}
 
-	if numRoutes == 1 {
+	if len(routes) == 1 {
+		return nil
+	}
+
+	//someone else claimed the same address at the same time; the lowest
+	//priority route wins and every other contender backs off
+	if resolveWinner(routes, myPriority) {
 		return nil
 	}
 
-	//address already in use
 	err = a.Delete()
 	if err != nil {
 		return handlerr(err)
 	}
 
-	return handlerr(fmt.Errorf("selected %v, but someone else selected it at the same time", a.IPNet))
+	return handlerr(fmt.Errorf("selected %v, but lost the tiebreak to a competing route", a.IPNet))
+}
+
+//resolveWinner reports whether myPriority is the unique lowest priority
+//among routes, meaning we keep our route while the other contenders
+//delete theirs and pick a new address. A tie at the lowest priority -
+//most commonly two attempts racing for the same address on this same
+//host, where the per-host tiebreaker is identical - is a win for no one:
+//every tied contender deletes its route and retries, falling back to the
+//same backoff-and-retry behavior used before routes carried a priority.
+func resolveWinner(routes []netlink.Route, myPriority uint32) bool {
+	min := myPriority
+	for _, r := range routes {
+		if p := uint32(r.Priority); p < min {
+			min = p
+		}
+	}
+	if min != myPriority {
+		return false
+	}
+
+	ties := 0
+	for _, r := range routes {
+		if uint32(r.Priority) == min {
+			ties++
+		}
+	}
+	return ties == 1
+}
+
+//waitForForeignRoute blocks until timeout elapses or a route update for a
+//foreign route to a.hostNet() is received on updates, whichever comes
+//first. Both RTM_NEWROUTE and RTM_DELROUTE are treated as a foreign event
+//worth reacting to: a new route means a contender just showed up, and a
+//delete means one just backed off, and either way the contention for
+//a.hostNet() just changed, so it's worth letting attempt() recheck routes
+//immediately instead of sitting out the rest of the propagation timeout.
+//It is shared by attempt and any future async watch API.
+func (a *Address) waitForForeignRoute(updates <-chan netlink.RouteUpdate, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case u, ok := <-updates:
+			if !ok {
+				return
+			}
+			if u.Type != unix.RTM_NEWROUTE && u.Type != unix.RTM_DELROUTE {
+				continue
+			}
+			if u.LinkIndex == a.linkIndex {
+				continue
+			}
+			if !sameDst(u.Route.Dst, a.hostNet()) {
+				continue
+			}
+			return
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+func sameDst(a, b *net.IPNet) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	return a.IP.Equal(b.IP) && bytes.Equal(a.Mask, b.Mask)
 }
 
 func (a *Address) hostNet() *net.IPNet {
@@ -178,6 +299,97 @@ func (a *Address) hostNet() *net.IPNet {
 	}
 }
 
+//Errors returned by Check, distinguishing drift from corruption so
+//orchestrators can decide how to react
+var (
+	//ErrRouteMissing means no host route was found inside the pool subnet;
+	//more than one host route inside it is not reported as an error
+	ErrRouteMissing = errors.New("no host route found for address")
+	//ErrWrongLink means the host route exists but is installed on the wrong link
+	ErrWrongLink = errors.New("host route is installed on the wrong link")
+	//ErrForeignProtocol means the host route exists but was not installed by this ipam
+	ErrForeignProtocol = errors.New("host route was not installed by this ipam")
+	//ErrAddrMissing means ASSIGN_ADDR is enabled but the address is not assigned to the link
+	ErrAddrMissing = errors.New("address is not assigned to link")
+)
+
+//Check verifies that the pool subnet a.IPNet still has a host route
+//allocated somewhere within it, and, if assignAddr is true, that the
+//allocated address is still assigned to linkIndex inside netnsPath. a.IPNet
+//here is the pool subnet passed on the CIDR CNI arg (as built by Get), not
+//the specific address New/Pool.Allocate picked for it - CHECK has no other
+//record of that address, so the host route is discovered by scanning every
+//route of the subnet's family for a host route that falls inside a.IPNet,
+//rather than recomputed from the subnet itself. Unlike ListOwned, the scan
+//does not filter on link or protocol: the first such route found is the
+//one checked, whichever link it is installed on.
+func (a *Address) Check(assignAddr bool, netnsPath string) error {
+	message := fmt.Sprintf("a.Check(%v, %v)", assignAddr, netnsPath)
+	log.Debugf(message)
+	handlerr := func(err error) error {
+		log.WithError(err).Error(message)
+		return fmt.Errorf("%v: %w", message, err)
+	}
+
+	routes, err := netlink.RouteListFiltered(familyOf(a.IP()), &netlink.Route{}, 0)
+	if err != nil {
+		return handlerr(err)
+	}
+
+	var found *netlink.Route
+	for i := range routes {
+		r := &routes[i]
+		if r.Dst == nil || !isHostRoute(r.Dst) || !a.IPNet.Contains(r.Dst.IP) {
+			continue
+		}
+		found = r
+		break
+	}
+	if found == nil {
+		return handlerr(ErrRouteMissing)
+	}
+	if found.LinkIndex != a.linkIndex {
+		return handlerr(ErrWrongLink)
+	}
+	if found.Protocol != DefaultRouteProtocol {
+		return handlerr(ErrForeignProtocol)
+	}
+
+	if !assignAddr {
+		return nil
+	}
+
+	h, closeHandle, err := handleAt(netnsPath)
+	if err != nil {
+		return handlerr(err)
+	}
+	defer closeHandle()
+
+	link, err := h.LinkByIndex(a.linkIndex)
+	if err != nil {
+		return handlerr(err)
+	}
+
+	addrs, err := h.AddrList(link, familyOf(found.Dst.IP))
+	if err != nil {
+		return handlerr(err)
+	}
+
+	for _, existing := range addrs {
+		if existing.IPNet.IP.Equal(found.Dst.IP) {
+			return nil
+		}
+	}
+
+	return handlerr(ErrAddrMissing)
+}
+
+//isHostRoute reports whether dst is a single-address route (a /32 or /128)
+func isHostRoute(dst *net.IPNet) bool {
+	ones, bits := dst.Mask.Size()
+	return ones == bits
+}
+
 //Delete deletes the address from the routing table
 func (a *Address) Delete() error {
 	message := "a.Delete()"
@@ -198,7 +410,163 @@ func (a *Address) Delete() error {
 	return nil
 }
 
-func (a *Address) numRoutes() (int, error) {
+//ListOwned returns an Address for every host route this ipam has installed
+//on linkIndex, discovered by Protocol rather than by a remembered CIDR, so
+//callers can free every address a container holds even across multiple
+//pools.
+func ListOwned(linkIndex int) ([]*Address, error) {
+	message := fmt.Sprintf("address.ListOwned(%v)", linkIndex)
+	log.Debugf(message)
+	handlerr := func(err error) error {
+		return fmt.Errorf("%v: %w", message, err)
+	}
+
+	routes, err := netlink.RouteListFiltered(0, &netlink.Route{
+		LinkIndex: linkIndex,
+		Protocol:  DefaultRouteProtocol,
+	}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		return nil, handlerr(err)
+	}
+
+	addrs := make([]*Address, 0, len(routes))
+	for _, r := range routes {
+		if r.Dst == nil {
+			continue
+		}
+		addrs = append(addrs, &Address{
+			IPNet:     r.Dst,
+			linkIndex: linkIndex,
+		})
+	}
+
+	return addrs, nil
+}
+
+//Assign adds the address to linkIndex using the subnet mask, removing any
+//stale addresses of the same family first. If netnsPath is not empty, the
+//link is resolved and the address applied inside that network namespace.
+func (a *Address) Assign(netnsPath string) error {
+	message := fmt.Sprintf("a.Assign(%v)", netnsPath)
+	log.Debugf(message)
+	handlerr := func(err error) error {
+		log.WithError(err).Error(message)
+		return fmt.Errorf("%v: %w", message, err)
+	}
+
+	h, closeHandle, err := handleAt(netnsPath)
+	if err != nil {
+		return handlerr(err)
+	}
+	defer closeHandle()
+
+	link, err := h.LinkByIndex(a.linkIndex)
+	if err != nil {
+		return handlerr(err)
+	}
+
+	addrs, err := h.AddrList(link, familyOf(a.IP()))
+	if err != nil {
+		return handlerr(err)
+	}
+
+	for _, existing := range addrs {
+		if existing.IPNet.IP.Equal(a.IP()) && bytes.Equal(existing.IPNet.Mask, a.IPNet.Mask) {
+			return nil
+		}
+		if err := h.AddrDel(link, &existing); err != nil {
+			return handlerr(err)
+		}
+	}
+
+	err = h.AddrAdd(link, &netlink.Addr{IPNet: a.IPNet})
+	if err != nil {
+		return handlerr(err)
+	}
+
+	return nil
+}
+
+//Unassign removes the address from linkIndex. If netnsPath is not empty,
+//the link is resolved and the address removed inside that network
+//namespace.
+func (a *Address) Unassign(netnsPath string) error {
+	message := fmt.Sprintf("a.Unassign(%v)", netnsPath)
+	log.Debugf(message)
+	handlerr := func(err error) error {
+		log.WithError(err).Error(message)
+		return fmt.Errorf("%v: %w", message, err)
+	}
+
+	h, closeHandle, err := handleAt(netnsPath)
+	if err != nil {
+		return handlerr(err)
+	}
+	defer closeHandle()
+
+	link, err := h.LinkByIndex(a.linkIndex)
+	if err != nil {
+		return handlerr(err)
+	}
+
+	addrs, err := h.AddrList(link, familyOf(a.IP()))
+	if err != nil {
+		return handlerr(err)
+	}
+
+	for _, existing := range addrs {
+		if !existing.IPNet.IP.Equal(a.IP()) {
+			continue
+		}
+		if err := h.AddrDel(link, &existing); err != nil {
+			return handlerr(err)
+		}
+		break
+	}
+
+	return nil
+}
+
+//handleAt returns a netlink handle in the namespace at netnsPath, or in the
+//current namespace if netnsPath is empty. The returned func releases the
+//handle (and namespace handle, if any) and must always be called.
+func handleAt(netnsPath string) (*netlink.Handle, func(), error) {
+	if netnsPath == "" {
+		h, err := netlink.NewHandle()
+		if err != nil {
+			return nil, nil, err
+		}
+		return h, h.Delete, nil
+	}
+
+	ns, err := netns.GetFromPath(netnsPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		ns.Close()
+		return nil, nil, err
+	}
+
+	return h, func() {
+		h.Delete()
+		ns.Close()
+	}, nil
+}
+
+func familyOf(ip net.IP) int {
+	if ip.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
+//numRoutes returns every route currently installed for a.hostNet(), so
+//callers can both count contenders and inspect their Priority. An
+//ECMP-merged multipath route is expanded into one entry per nexthop.
+func (a *Address) numRoutes() ([]netlink.Route, error) {
 	message := "a.numRoutes()"
 	handlerr := func(err error) error {
 		return fmt.Errorf("%v: %w", message, err)
@@ -206,14 +574,18 @@ func (a *Address) numRoutes() (int, error) {
 
 	routes, err := netlink.RouteListFiltered(0, &netlink.Route{Dst: a.hostNet()}, netlink.RT_FILTER_DST)
 	if err != nil {
-		return -1, handlerr(err)
-	}
-	if len(routes) != 1 {
-		return len(routes), nil
+		return nil, handlerr(err)
 	}
-	if len(routes[0].MultiPath) != 0 {
-		return len(routes[0].MultiPath), nil
+	if len(routes) != 1 || len(routes[0].MultiPath) == 0 {
+		return routes, nil
 	}
 
-	return 1, nil
+	expanded := make([]netlink.Route, len(routes[0].MultiPath))
+	for i, nh := range routes[0].MultiPath {
+		r := routes[0]
+		r.LinkIndex = nh.LinkIndex
+		r.MultiPath = nil
+		expanded[i] = r
+	}
+	return expanded, nil
 }
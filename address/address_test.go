@@ -0,0 +1,55 @@
+package address
+
+import (
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestResolveWinner(t *testing.T) {
+	cases := []struct {
+		name       string
+		myPriority uint32
+		routes     []netlink.Route
+		want       bool
+	}{
+		{
+			name:       "only route is mine",
+			myPriority: 10,
+			routes:     []netlink.Route{{Priority: 10}},
+			want:       true,
+		},
+		{
+			name:       "unique lowest priority wins",
+			myPriority: 10,
+			routes:     []netlink.Route{{Priority: 10}, {Priority: 20}},
+			want:       true,
+		},
+		{
+			name:       "someone else has strictly lower priority",
+			myPriority: 10,
+			routes:     []netlink.Route{{Priority: 10}, {Priority: 5}},
+			want:       false,
+		},
+		{
+			name:       "tie at the lowest priority, e.g. two attempts on the same host",
+			myPriority: 10,
+			routes:     []netlink.Route{{Priority: 10}, {Priority: 10}},
+			want:       false,
+		},
+		{
+			name:       "tie among several contenders",
+			myPriority: 10,
+			routes:     []netlink.Route{{Priority: 10}, {Priority: 10}, {Priority: 10}},
+			want:       false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := resolveWinner(c.routes, c.myPriority); got != c.want {
+				t.Errorf("resolveWinner() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
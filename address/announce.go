@@ -0,0 +1,171 @@
+package address
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+//DefaultAnnounceInterval is the spacing between repeated announcements,
+//matching the probe interval suggested by RFC 5227 §2.3
+const DefaultAnnounceInterval = 100 * time.Millisecond
+
+//DefaultAnnounceCount is the number of times Announce repeats by default
+const DefaultAnnounceCount = 3
+
+var broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+//ipv6AllNodesMAC is the multicast MAC corresponding to the ff02::1
+//all-nodes address, used as the destination for unsolicited NAs
+var ipv6AllNodesMAC = net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x01}
+
+//Announce sends count gratuitous ARP requests (IPv4) or unsolicited
+//neighbor advertisements (IPv6) for a out of linkIndex, spaced
+//DefaultAnnounceInterval apart, so peer hosts and switches update their
+//neighbor caches immediately rather than waiting for the next ARP/ND cycle.
+func (a *Address) Announce(count int) error {
+	message := fmt.Sprintf("a.Announce(%v)", count)
+	log.Debugf(message)
+	handlerr := func(err error) error {
+		log.WithError(err).Error(message)
+		return fmt.Errorf("%v: %w", message, err)
+	}
+
+	link, err := netlink.LinkByIndex(a.linkIndex)
+	if err != nil {
+		return handlerr(err)
+	}
+
+	srcMAC := link.Attrs().HardwareAddr
+	frame, err := a.announceFrame(srcMAC)
+	if err != nil {
+		return handlerr(err)
+	}
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return handlerr(err)
+	}
+	defer unix.Close(fd)
+
+	sa := &unix.SockaddrLinklayer{Ifindex: a.linkIndex}
+
+	for i := 0; i < count; i++ {
+		if err := unix.Sendto(fd, frame, 0, sa); err != nil {
+			return handlerr(err)
+		}
+		if i < count-1 {
+			time.Sleep(DefaultAnnounceInterval)
+		}
+	}
+
+	return nil
+}
+
+//announceFrame builds the raw ethernet frame to send for a, selecting a
+//gratuitous ARP request for an IPv4 address or an unsolicited neighbor
+//advertisement for an IPv6 address
+func (a *Address) announceFrame(srcMAC net.HardwareAddr) ([]byte, error) {
+	if ip4 := a.IP().To4(); ip4 != nil {
+		return garpFrame(srcMAC, ip4), nil
+	}
+	return unaFrame(srcMAC, a.IP())
+}
+
+//garpFrame builds an ethernet frame carrying a gratuitous ARP request:
+//both the sender and target protocol addresses are set to ip, and the
+//target hardware address is left zeroed, per RFC 5227 §2.3
+func garpFrame(srcMAC net.HardwareAddr, ip net.IP) []byte {
+	arp := make([]byte, 28)
+	binary.BigEndian.PutUint16(arp[0:2], 1)      // HTYPE: ethernet
+	binary.BigEndian.PutUint16(arp[2:4], 0x0800) // PTYPE: IPv4
+	arp[4] = 6                                   // HLEN
+	arp[5] = 4                                   // PLEN
+	binary.BigEndian.PutUint16(arp[6:8], 1)      // OPER: request
+	copy(arp[8:14], srcMAC)                      // SHA
+	copy(arp[14:18], ip)                         // SPA
+	// THA (arp[18:24]) left zeroed
+	copy(arp[24:28], ip) // TPA
+
+	return ethernetFrame(srcMAC, broadcastMAC, 0x0806, arp)
+}
+
+//unaFrame builds an ethernet frame carrying an unsolicited ICMPv6 neighbor
+//advertisement announcing the mapping between ip and srcMAC, with the
+//override flag set so receivers replace any cached entry
+func unaFrame(srcMAC net.HardwareAddr, ip net.IP) ([]byte, error) {
+	ip6 := ip.To16()
+	if ip6 == nil {
+		return nil, fmt.Errorf("%v is not a valid IPv6 address", ip)
+	}
+
+	dst := net.ParseIP("ff02::1")
+
+	icmp := make([]byte, 32)
+	icmp[0] = 136 // type: neighbor advertisement
+	icmp[1] = 0   // code
+	// icmp[2:4] checksum filled in below
+	icmp[4] = 0x20 // flags: override
+	copy(icmp[8:24], ip6)
+	icmp[24] = 2 // option type: target link-layer address
+	icmp[25] = 1 // option length, in units of 8 octets
+	copy(icmp[26:32], srcMAC)
+
+	binary.BigEndian.PutUint16(icmp[2:4], icmp6Checksum(ip6, dst, icmp))
+
+	ip6Hdr := make([]byte, 40)
+	ip6Hdr[0] = 0x60 // version 6
+	binary.BigEndian.PutUint16(ip6Hdr[4:6], uint16(len(icmp)))
+	ip6Hdr[6] = 58 // next header: ICMPv6
+	ip6Hdr[7] = 255
+	copy(ip6Hdr[8:24], ip6)
+	copy(ip6Hdr[24:40], dst)
+
+	return ethernetFrame(srcMAC, ipv6AllNodesMAC, 0x86DD, append(ip6Hdr, icmp...)), nil
+}
+
+//ethernetFrame prepends a standard 14-byte ethernet header to payload
+func ethernetFrame(src, dst net.HardwareAddr, ethType uint16, payload []byte) []byte {
+	frame := make([]byte, 14+len(payload))
+	copy(frame[0:6], dst)
+	copy(frame[6:12], src)
+	binary.BigEndian.PutUint16(frame[12:14], ethType)
+	copy(frame[14:], payload)
+	return frame
+}
+
+//icmp6Checksum computes the ICMPv6 checksum over its IPv6 pseudo-header
+//and the packet itself, with the checksum field assumed to be zero
+func icmp6Checksum(src, dst net.IP, icmp []byte) uint16 {
+	pseudo := make([]byte, 40+len(icmp))
+	copy(pseudo[0:16], src)
+	copy(pseudo[16:32], dst)
+	binary.BigEndian.PutUint32(pseudo[32:36], uint32(len(icmp)))
+	pseudo[39] = 58 // next header: ICMPv6
+	copy(pseudo[40:], icmp)
+
+	var sum uint32
+	for i := 0; i+1 < len(pseudo); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(pseudo[i : i+2]))
+	}
+	if len(pseudo)%2 != 0 {
+		sum += uint32(pseudo[len(pseudo)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+
+	return ^uint16(sum)
+}
+
+//htons converts a uint16 from host to network byte order
+func htons(v uint16) uint16 {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return binary.LittleEndian.Uint16(b)
+}
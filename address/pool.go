@@ -0,0 +1,149 @@
+package address
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+//PoolPreference controls the order in which a Pool's subnets are tried
+type PoolPreference string
+
+const (
+	//PoolPreferV4First tries IPv4 subnets before IPv6 subnets
+	PoolPreferV4First PoolPreference = "v4first"
+	//PoolPreferV6First tries IPv6 subnets before IPv4 subnets
+	PoolPreferV6First PoolPreference = "v6first"
+	//PoolPreferRoundRobin tries subnets in the order they were given
+	PoolPreferRoundRobin PoolPreference = "roundrobin"
+)
+
+//PoolSubnet is a single candidate subnet within a Pool, along with the
+//addresses to exclude from the search space at each end of it
+type PoolSubnet struct {
+	IPNet        *net.IPNet
+	ExcludeFirst int
+	ExcludeLast  int
+}
+
+//Pool is an ordered set of candidate subnets to allocate addresses from.
+//Allocate walks the subnets in the order set by Preference and returns one
+//Address per subnet it successfully allocates from, so a single ADD can
+//hand back both an IPv4 and an IPv6 address for a dual-stack pod.
+type Pool struct {
+	Subnets    []*PoolSubnet
+	Preference PoolPreference
+}
+
+//NewPool parses a comma-separated CIDR list, as accepted by the CIDR CNI
+//arg, into a Pool. excludeFirst and excludeLast are applied to every
+//subnet in the pool. A Pool holds at most one subnet per address family:
+//Assign() removes any address of the same family it doesn't recognize
+//before adding its own, so a second subnet of the same family would have
+//its address deleted out from under it the moment its sibling is assigned.
+func NewPool(cidrs string, excludeFirst, excludeLast int, pref PoolPreference) (*Pool, error) {
+	message := fmt.Sprintf("address.NewPool(%v, %v, %v, %v)", cidrs, excludeFirst, excludeLast, pref)
+	log.Debugf(message)
+	handlerr := func(err error) error {
+		return fmt.Errorf("%v: %w", message, err)
+	}
+
+	parts := strings.Split(cidrs, ",")
+	subnets := make([]*PoolSubnet, 0, len(parts))
+	seenFamily := map[int]bool{}
+	for _, c := range parts {
+		ipnet, err := netlink.ParseIPNet(strings.TrimSpace(c))
+		if err != nil {
+			return nil, handlerr(err)
+		}
+
+		family := familyOf(ipnet.IP)
+		if seenFamily[family] {
+			return nil, handlerr(fmt.Errorf("pool already has a subnet for the address family of %v", c))
+		}
+		seenFamily[family] = true
+
+		subnets = append(subnets, &PoolSubnet{
+			IPNet:        ipnet,
+			ExcludeFirst: excludeFirst,
+			ExcludeLast:  excludeLast,
+		})
+	}
+
+	return &Pool{Subnets: subnets, Preference: pref}, nil
+}
+
+//Allocate tries each subnet in the pool, in the order set by Preference,
+//and returns one Address per subnet it successfully allocates from. If any
+//subnet fails, every address already claimed by this call is rolled back
+//before the error is returned.
+func (p *Pool) Allocate(linkIndex int) ([]*Address, error) {
+	message := fmt.Sprintf("Pool.Allocate(%v)", linkIndex)
+	log.Debugf(message)
+	handlerr := func(err error) error {
+		log.WithError(err).Error(message)
+		return fmt.Errorf("%v: %w", message, err)
+	}
+
+	addrs := make([]*Address, 0, len(p.Subnets))
+	for _, s := range p.ordered() {
+		a := &Address{
+			IPNet:     &net.IPNet{IP: s.IPNet.IP, Mask: s.IPNet.Mask},
+			linkIndex: linkIndex,
+		}
+
+		if err := a.allocate(s.ExcludeFirst, s.ExcludeLast); err != nil {
+			for _, done := range addrs {
+				_ = done.Delete()
+			}
+			return nil, handlerr(err)
+		}
+
+		addrs = append(addrs, a)
+	}
+
+	return addrs, nil
+}
+
+//ordered returns p.Subnets sorted by Preference, leaving p.Subnets itself
+//untouched
+func (p *Pool) ordered() []*PoolSubnet {
+	if p.Preference != PoolPreferV4First && p.Preference != PoolPreferV6First {
+		return p.Subnets
+	}
+
+	ordered := make([]*PoolSubnet, len(p.Subnets))
+	copy(ordered, p.Subnets)
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return precedence(ordered[i].IPNet, p.Preference) > precedence(ordered[j].IPNet, p.Preference)
+	})
+
+	return ordered
+}
+
+//precedence mirrors the label+precedence shape of an RFC 6724 style
+//address-selection policy table, collapsed to the two families a Pool can
+//hold, so the preferred family is tried first.
+func precedence(ipnet *net.IPNet, pref PoolPreference) int {
+	isV4 := ipnet.IP.To4() != nil
+
+	switch pref {
+	case PoolPreferV4First:
+		if isV4 {
+			return 1
+		}
+		return 0
+	case PoolPreferV6First:
+		if isV4 {
+			return 0
+		}
+		return 1
+	default:
+		return 0
+	}
+}
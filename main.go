@@ -1,9 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 	cni "github.com/travishegner/go-libcni"
@@ -87,9 +89,45 @@ func main() {
 		}
 	}
 
+	assignAddr := vars.NetworkNamespace != ""
+	saa, ok := vars.GetArg("ASSIGN_ADDR")
+	if ok {
+		assignAddr, err = strconv.ParseBool(saa)
+		if err != nil {
+			exitCode, exitOutput = cni.PrepareExit(err, 11, "couldn't parse ASSIGN_ADDR")
+			return
+		}
+	}
+
+	poolPref := address.PoolPreferRoundRobin
+	spp, ok := vars.GetArg("POOL_PREF")
+	if ok {
+		poolPref = address.PoolPreference(spp)
+	}
+
+	announce := false
+	san, ok := vars.GetArg("ANNOUNCE")
+	if ok {
+		announce, err = strconv.ParseBool(san)
+		if err != nil {
+			exitCode, exitOutput = cni.PrepareExit(err, 11, "couldn't parse ANNOUNCE")
+			return
+		}
+	}
+
+	announceCount := address.DefaultAnnounceCount
+	sac, ok := vars.GetArg("ANNOUNCE_COUNT")
+	if ok {
+		announceCount, err = strconv.Atoi(sac)
+		if err != nil {
+			exitCode, exitOutput = cni.PrepareExit(err, 11, "couldn't parse ANNOUNCE_COUNT")
+			return
+		}
+	}
+
 	switch vars.Command {
 	case "ADD":
-		result, err := handleAdd(cidr, li, xf, xl)
+		result, err := handleAdd(cidr, li, xf, xl, poolPref, assignAddr, vars.NetworkNamespace, announce, announceCount)
 		if err != nil {
 			log.WithError(err).Error("error while handling add")
 			exitCode, exitOutput = cni.PrepareExit(err, 11, "failed while adding address")
@@ -98,17 +136,24 @@ func main() {
 
 		os.Stdout.Write(result)
 	case "DEL":
-		err := handleDel(cidr, li)
+		err := handleDel(li, assignAddr, vars.NetworkNamespace)
 		if err != nil {
 			log.WithError(err).Error("error while handling del")
 			exitCode, exitOutput = cni.PrepareExit(err, 11, "failed while deleting address")
 			return
 		}
 	case "CHECK":
-		err := handleCheck(cidr, li)
+		err := handleCheck(cidr, li, assignAddr, vars.NetworkNamespace)
 		if err != nil {
 			log.WithError(err).Error("error while handling check")
-			exitCode, exitOutput = cni.PrepareExit(err, 11, "failed while checking address")
+			code := 11
+			switch {
+			case errors.Is(err, address.ErrWrongLink):
+				code = 12
+			case errors.Is(err, address.ErrForeignProtocol):
+				code = 13
+			}
+			exitCode, exitOutput = cni.PrepareExit(err, code, "failed while checking address")
 			return
 		}
 	default:
@@ -123,22 +168,43 @@ func exit(code int, output []byte) {
 	os.Exit(code)
 }
 
-func handleAdd(cidr string, linkIndex, excludeFirst, excludeLast int) ([]byte, error) {
-	log.Debugf("handleAdd(%v, %v, %v, %v)", cidr, linkIndex, excludeFirst, excludeLast)
+func handleAdd(cidr string, linkIndex, excludeFirst, excludeLast int, poolPref address.PoolPreference, assignAddr bool, netns string, announce bool, announceCount int) ([]byte, error) {
+	log.Debugf("handleAdd(%v, %v, %v, %v, %v, %v, %v, %v, %v)", cidr, linkIndex, excludeFirst, excludeLast, poolPref, assignAddr, netns, announce, announceCount)
 
-	addr, err := address.New(cidr, linkIndex, excludeFirst, excludeLast)
+	pool, err := address.NewPool(cidr, excludeFirst, excludeLast, poolPref)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create new address %v: %w", cidr, err)
+		return nil, fmt.Errorf("failed to parse pool %v: %w", cidr, err)
 	}
-	ipVer := "4"
-	if addr.IPNet.IP.To4() == nil {
-		ipVer = "6"
+
+	addrs, err := pool.Allocate(linkIndex)
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate from pool %v: %w", cidr, err)
 	}
-	ips := make([]*cni.IP, 1)
-	ips[0] = &cni.IP{
-		Version: ipVer,
-		Address: addr.IPNet.String(),
+
+	ips := make([]*cni.IP, len(addrs))
+	for i, addr := range addrs {
+		if assignAddr {
+			if err := addr.Assign(netns); err != nil {
+				return nil, fmt.Errorf("failed to assign address %v: %w", addr.IPNet, err)
+			}
+		}
+
+		if announce {
+			if err := addr.Announce(announceCount); err != nil {
+				log.WithError(err).Warningf("failed to announce address %v", addr.IPNet)
+			}
+		}
+
+		ipVer := "4"
+		if addr.IPNet.IP.To4() == nil {
+			ipVer = "6"
+		}
+		ips[i] = &cni.IP{
+			Version: ipVer,
+			Address: addr.IPNet.String(),
+		}
 	}
+
 	result := &cni.Result{
 		CNIVersion: cni.CNIVersion,
 		IPs:        ips,
@@ -147,23 +213,42 @@ func handleAdd(cidr string, linkIndex, excludeFirst, excludeLast int) ([]byte, e
 	return result.Marshal(), nil
 }
 
-func handleDel(cidr string, linkIndex int) error {
-	log.Debugf("handleDel(%v, %v)", cidr, linkIndex)
+func handleDel(linkIndex int, assignAddr bool, netns string) error {
+	log.Debugf("handleDel(%v, %v, %v)", linkIndex, assignAddr, netns)
 
-	addr, err := address.Get(cidr, linkIndex)
+	addrs, err := address.ListOwned(linkIndex)
 	if err != nil {
-		return fmt.Errorf("failed to get address %v: %w", cidr, err)
+		return fmt.Errorf("failed to list addresses owned on link %v: %w", linkIndex, err)
 	}
 
-	err = addr.Delete()
-	if err != nil {
-		return fmt.Errorf("failed to delete address %v: %w", cidr, err)
+	for _, addr := range addrs {
+		if assignAddr {
+			if err := addr.Unassign(netns); err != nil {
+				return fmt.Errorf("failed to unassign address %v: %w", addr.IPNet, err)
+			}
+		}
+
+		if err := addr.Delete(); err != nil {
+			return fmt.Errorf("failed to delete address %v: %w", addr.IPNet, err)
+		}
 	}
 
 	return nil
 }
 
-func handleCheck(cidr string, linkIndex int) error {
-	log.Debugf("handleCheck(%v, %v)", cidr, linkIndex)
+func handleCheck(cidr string, linkIndex int, assignAddr bool, netns string) error {
+	log.Debugf("handleCheck(%v, %v, %v, %v)", cidr, linkIndex, assignAddr, netns)
+
+	for _, c := range strings.Split(cidr, ",") {
+		addr, err := address.Get(strings.TrimSpace(c), linkIndex)
+		if err != nil {
+			return fmt.Errorf("failed to get address %v: %w", c, err)
+		}
+
+		if err := addr.Check(assignAddr, netns); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }